@@ -0,0 +1,88 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package utils holds small generic helpers shared across netd's internal
+// packages.
+package utils
+
+import (
+	"io"
+	"sync"
+)
+
+// Callback lets a producer of T values fan them out to subscribers that
+// register and unregister at runtime, without the producer needing to know
+// how many subscribers exist or who they are. It's the mechanism
+// config.Set uses to let a metrics exporter, a CRD status writer, or an
+// audit log observe Config transitions without polling.
+type Callback[T any] struct {
+	mu          sync.RWMutex
+	subscribers map[int]func(T)
+	nextID      int
+}
+
+// Register adds fn as a subscriber and returns an io.Closer that
+// unregisters it. Safe for concurrent use with Emit and other Registers.
+func (c *Callback[T]) Register(fn func(T)) io.Closer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.subscribers == nil {
+		c.subscribers = make(map[int]func(T))
+	}
+	id := c.nextID
+	c.nextID++
+	c.subscribers[id] = fn
+
+	return &callbackHandle[T]{cb: c, id: id}
+}
+
+// Emit calls every currently-registered subscriber with v. Subscribers
+// registered or unregistered during Emit do not affect the current call.
+//
+// The subscriber list is snapshotted and the lock released before any fn is
+// called, so a subscriber is free to Register or Close its own handle (or
+// another one) synchronously from within its callback without deadlocking
+// against the RWMutex below.
+func (c *Callback[T]) Emit(v T) {
+	c.mu.RLock()
+	fns := make([]func(T), 0, len(c.subscribers))
+	for _, fn := range c.subscribers {
+		fns = append(fns, fn)
+	}
+	c.mu.RUnlock()
+
+	for _, fn := range fns {
+		fn(v)
+	}
+}
+
+func (c *Callback[T]) unregister(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.subscribers, id)
+}
+
+// callbackHandle is the io.Closer returned by Callback.Register.
+type callbackHandle[T any] struct {
+	cb *Callback[T]
+	id int
+}
+
+func (h *callbackHandle[T]) Close() error {
+	h.cb.unregister(h.id)
+	return nil
+}
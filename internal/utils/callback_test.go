@@ -0,0 +1,77 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import "testing"
+
+func TestCallbackEmit(t *testing.T) {
+	var c Callback[int]
+	var got []int
+	c.Register(func(v int) { got = append(got, v) })
+	c.Emit(1)
+	c.Emit(2)
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("got %v, want [1 2]", got)
+	}
+}
+
+func TestCallbackUnregister(t *testing.T) {
+	var c Callback[int]
+	var got []int
+	handle := c.Register(func(v int) { got = append(got, v) })
+	c.Emit(1)
+	handle.Close()
+	c.Emit(2)
+	if len(got) != 1 || got[0] != 1 {
+		t.Fatalf("got %v, want [1]", got)
+	}
+}
+
+// TestCallbackCloseDuringEmit exercises the "observe once" pattern the
+// metrics/CRD/audit consumers config.Set.RegisterCallback is meant to
+// support: a subscriber that closes its own handle synchronously from
+// within the callback it's currently running in. This must not deadlock.
+func TestCallbackCloseDuringEmit(t *testing.T) {
+	var c Callback[int]
+	var handle interface{ Close() error }
+	calls := 0
+	handle = c.Register(func(v int) {
+		calls++
+		handle.Close()
+	})
+	c.Emit(1)
+	c.Emit(2)
+	if calls != 1 {
+		t.Fatalf("calls = %d, want 1 (subscriber should have unregistered itself)", calls)
+	}
+}
+
+// TestCallbackRegisterDuringEmit exercises a subscriber registering a new
+// subscriber synchronously from within its own callback; this must not
+// deadlock either.
+func TestCallbackRegisterDuringEmit(t *testing.T) {
+	var c Callback[int]
+	var second int
+	c.Register(func(v int) {
+		c.Register(func(v int) { second++ })
+	})
+	c.Emit(1)
+	c.Emit(2)
+	if second != 1 {
+		t.Fatalf("second = %d, want 1 (registered after first Emit, should only see the second)", second)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"io"
+
+	"github.com/golang/glog"
+
+	"github.com/GoogleCloudPlatform/netd/internal/utils"
+)
+
+// Config is a single piece of host network configuration (an iptables
+// rule, a sysctl, a route, a rule, ...) that can be installed and removed
+// idempotently.
+type Config interface {
+	// Add applies the configuration to the host. It must be safe to call
+	// more than once.
+	Add() error
+	// Remove reverts the configuration from the host. It must be safe to
+	// call even if Add was never called.
+	Remove() error
+}
+
+// ConfigAction identifies which transition a ConfigEvent describes.
+type ConfigAction int
+
+const (
+	// ConfigApplied means the Config's Add succeeded.
+	ConfigApplied ConfigAction = iota
+	// ConfigReverted means the Config's Remove succeeded.
+	ConfigReverted
+	// ConfigFailed means the Config's Add or Remove returned an error.
+	ConfigFailed
+)
+
+// ConfigEvent is emitted to a Set's registered callbacks whenever one of
+// its Configs is applied, reverted, or fails to converge.
+type ConfigEvent struct {
+	Config Config
+	Action ConfigAction
+	// Err is set when Action is ConfigFailed.
+	Err error
+}
+
+// Set is a named, ordered collection of Configs that are applied and
+// reverted together.
+type Set struct {
+	initialized bool
+	Name        string
+	Configs     []Config
+
+	// callbacks fans out ConfigEvents as Apply/Revert run; nil until the
+	// first RegisterCallback, Apply or Revert, each of which allocates it
+	// through callbackHub.
+	callbacks *utils.Callback[ConfigEvent]
+}
+
+// RegisterCallback subscribes fn to every ConfigEvent this Set emits as its
+// Configs are applied, reverted, or fail to converge. The returned Closer
+// unregisters fn; it can also be passed to UnregisterCallback.
+func (s *Set) RegisterCallback(fn func(ConfigEvent)) io.Closer {
+	return s.callbackHub().Register(fn)
+}
+
+// UnregisterCallback stops handle, as returned by a prior RegisterCallback
+// on this Set, from receiving further events.
+func (s *Set) UnregisterCallback(handle io.Closer) error {
+	return handle.Close()
+}
+
+func (s *Set) callbackHub() *utils.Callback[ConfigEvent] {
+	if s.callbacks == nil {
+		s.callbacks = &utils.Callback[ConfigEvent]{}
+	}
+	return s.callbacks
+}
+
+// Apply installs every Config in the Set, in order, stopping at the first
+// error.
+func (s *Set) Apply() error {
+	for _, c := range s.Configs {
+		if err := c.Add(); err != nil {
+			s.callbackHub().Emit(ConfigEvent{Config: c, Action: ConfigFailed, Err: err})
+			return err
+		}
+		s.callbackHub().Emit(ConfigEvent{Config: c, Action: ConfigApplied})
+	}
+	s.initialized = true
+	return nil
+}
+
+// Revert removes every Config in the Set, in order, continuing past
+// individual errors and returning the last one seen.
+func (s *Set) Revert() error {
+	var lastErr error
+	for _, c := range s.Configs {
+		if err := c.Remove(); err != nil {
+			lastErr = err
+			s.callbackHub().Emit(ConfigEvent{Config: c, Action: ConfigFailed, Err: err})
+			continue
+		}
+		s.callbackHub().Emit(ConfigEvent{Config: c, Action: ConfigReverted})
+	}
+	s.initialized = false
+	return lastErr
+}
+
+// emitConfigAdd applies c and reports the outcome to
+// PolicyRoutingConfigSet's callbacks, for the ad hoc single-Config
+// add/remove cycles the route monitor and multi-NIC reconciler do outside
+// of a full Set.Apply/Revert pass. It returns c.Add's error so callers can
+// tell whether the Config actually converged.
+func emitConfigAdd(c Config) error {
+	if err := c.Add(); err != nil {
+		glog.Errorf("applying %+v: %v", c, err)
+		PolicyRoutingConfigSet.callbackHub().Emit(ConfigEvent{Config: c, Action: ConfigFailed, Err: err})
+		return err
+	}
+	PolicyRoutingConfigSet.callbackHub().Emit(ConfigEvent{Config: c, Action: ConfigApplied})
+	return nil
+}
+
+// emitConfigRemove is emitConfigAdd's Remove counterpart.
+func emitConfigRemove(c Config) error {
+	if err := c.Remove(); err != nil {
+		glog.Errorf("reverting %+v: %v", c, err)
+		PolicyRoutingConfigSet.callbackHub().Emit(ConfigEvent{Config: c, Action: ConfigFailed, Err: err})
+		return err
+	}
+	PolicyRoutingConfigSet.callbackHub().Emit(ConfigEvent{Config: c, Action: ConfigReverted})
+	return nil
+}
@@ -18,6 +18,7 @@ package config
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"net"
 
@@ -25,78 +26,287 @@ import (
 
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/golang/glog"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 
 	"github.com/GoogleCloudPlatform/netd/internal/ipt"
 )
 
+// policyRoutingBackend lets operators on nft-only distros (or hosts running
+// iptables-nft, where the legacy xtables path is a compat shim) force which
+// ruleset netd installs its packet-marking chains into.
+var policyRoutingBackend = flag.String("policy-routing-backend", "auto",
+	`backend used to install policy routing packet-marking rules: "iptables", "nftables", or "auto" to detect based on host capabilities`)
+
+// resolvePolicyRoutingBackend turns the -policy-routing-backend flag into a
+// concrete choice, falling back to host detection for "auto".
+func resolvePolicyRoutingBackend() string {
+	switch *policyRoutingBackend {
+	case "iptables", "nftables":
+		return *policyRoutingBackend
+	default:
+		if detectNftablesBackend() {
+			return "nftables"
+		}
+		return "iptables"
+	}
+}
+
 const (
 	sysctlSrcValidMark = "net.ipv4.conf.all.src_valid_mark"
 )
 
 const (
-	tableMangle         = "mangle"
-	preRoutingChain     = "PREROUTING"
-	postRoutingChain    = "POSTROUTING"
-	gcpPreRoutingChain  = "GCP-PREROUTING"
-	gcpPostRoutingChain = "GCP-POSTROUTING"
-	hairpinMark         = 0x4000
-	hairpinMask         = 0x4000
+	tableMangle      = "mangle"
+	preRoutingChain  = "PREROUTING"
+	postRoutingChain = "POSTROUTING"
 )
+
+// PolicyRoutingOptions configures the route table, rule priorities, packet
+// mark/mask, and chain name prefix used to build a PolicyRoutingConfigSet.
+// The defaults match netd's historical hard-coded values; operators running
+// other node daemons that already claim table 1, the 30000-series rule
+// priority range, or the 0x4000 fwmark bit can override them so the two
+// don't collide.
+type PolicyRoutingOptions struct {
+	// Table is the custom route table netd installs the default-NIC
+	// default route into.
+	Table int
+	// HairpinRulePriority, LocalRulePriority, and PolicyRoutingRulePriority
+	// are the ip rule priorities for, respectively: the hairpin-mark
+	// rule, the loopback rule, and the default-NIC-invert rule that
+	// sends everything else to Table.
+	HairpinRulePriority       int
+	LocalRulePriority         int
+	PolicyRoutingRulePriority int
+	// HairpinMark and HairpinMask select which packets get their conn
+	// mark saved on the way out; see policyRoutingGcpPostRoutingComment in
+	// markChainConfigs.
+	HairpinMark uint32
+	HairpinMask uint32
+	// ChainPrefix replaces the "GCP-" prefix on the
+	// <prefix>PREROUTING/<prefix>POSTROUTING chains netd installs.
+	ChainPrefix string
+	// ReversePathFilterValue is written to
+	// net.ipv4.conf.<dev>.rp_filter for the default NIC, and, after
+	// reversePathFilterValueV6 adapts it, to net.ipv6.conf.<dev>.rp_filter
+	// for the default IPv6 NIC.
+	ReversePathFilterValue string
+}
+
+// DefaultPolicyRoutingOptions reproduces netd's historical fixed
+// configuration.
+var DefaultPolicyRoutingOptions = PolicyRoutingOptions{
+	Table:                     1,
+	HairpinRulePriority:       30000,
+	LocalRulePriority:         30001,
+	PolicyRoutingRulePriority: 30002,
+	HairpinMark:               0x4000,
+	HairpinMask:               0x4000,
+	ChainPrefix:               "GCP-",
+	ReversePathFilterValue:    "2",
+}
+
+// reservedMarks lists fwmark bits already claimed by common node daemons
+// netd is typically deployed alongside; Validate rejects a HairpinMark that
+// collides with one of them.
+var reservedMarks = map[uint32]string{
+	0x200:  "kube-proxy service/masquerade mark",
+	0x800:  "Cilium encryption mark",
+	0xe00:  "Cilium to-proxy mark",
+	0xf00:  "Cilium trace mark",
+	0x4000: "netd hairpin mark (default)",
+}
+
+// reservedTables lists route table ids already claimed by common node
+// daemons netd is typically deployed alongside; Validate rejects a Table
+// that collides with one of them.
+var reservedTables = map[int]string{
+	1: "Cilium's local-node routing table (also netd's historical default)",
+}
+
+// reservedPriorityRangeStart/End bound the RoutingPolicyRule priority range
+// systemd-networkd assigns its own default rules, 30000-30999. netd's
+// historical hairpin/local/policy-routing rule priorities (30000-30002) sit
+// inside it deliberately, so Validate only rejects a priority in this range
+// when it doesn't match the corresponding historical default.
 const (
-	policyRoutingGcpPreRoutingComment  = "restore the conn mark if applicable"
-	policyRoutingPreRoutingComment     = "redirect all traffic to GCP-PREROUTING chain"
-	policyRoutingGcpPostRoutingComment = "save the conn mark only if hairpin bit (0x4000/0x4000) is set"
-	policyRoutingPostRoutingComment    = "redirect all traffic to GCP-POSTROUTING chain"
+	reservedPriorityRangeStart = 30000
+	reservedPriorityRangeEnd   = 30999
 )
 
-const (
-	customRouteTable    = 1
-	hairpinRulePriority = 30000 + iota
-	localRulePriority
-	policyRoutingRulePriority
+// Validate checks o for internal consistency and known collisions with
+// other node daemons' route table, rule priority, and fwmark usage.
+func (o PolicyRoutingOptions) Validate() error {
+	if o.HairpinMark&^o.HairpinMask != 0 {
+		return fmt.Errorf("policy routing: hairpin mark 0x%x is not fully covered by mask 0x%x", o.HairpinMark, o.HairpinMask)
+	}
+	if owner, ok := reservedMarks[o.HairpinMark]; ok && o.HairpinMark != DefaultPolicyRoutingOptions.HairpinMark {
+		return fmt.Errorf("policy routing: hairpin mark 0x%x collides with %s", o.HairpinMark, owner)
+	}
+	if owner, ok := reservedTables[o.Table]; ok && o.Table != DefaultPolicyRoutingOptions.Table {
+		return fmt.Errorf("policy routing: table %d collides with %s", o.Table, owner)
+	}
+
+	priorityChecks := []struct {
+		Priority int
+		Default  int
+		Name     string
+	}{
+		{o.HairpinRulePriority, DefaultPolicyRoutingOptions.HairpinRulePriority, "hairpin rule"},
+		{o.LocalRulePriority, DefaultPolicyRoutingOptions.LocalRulePriority, "local rule"},
+		{o.PolicyRoutingRulePriority, DefaultPolicyRoutingOptions.PolicyRoutingRulePriority, "policy routing rule"},
+	}
+	for _, c := range priorityChecks {
+		if c.Priority != c.Default && c.Priority >= reservedPriorityRangeStart && c.Priority <= reservedPriorityRangeEnd {
+			return fmt.Errorf("policy routing: %s priority %d falls in the %d-%d range reserved by systemd-networkd's default RoutingPolicyRule priorities", c.Name, c.Priority, reservedPriorityRangeStart, reservedPriorityRangeEnd)
+		}
+	}
+
+	priorities := map[int]string{
+		o.HairpinRulePriority:       "hairpin rule",
+		o.LocalRulePriority:         "local rule",
+		o.PolicyRoutingRulePriority: "policy routing rule",
+	}
+	if len(priorities) != 3 {
+		return fmt.Errorf("policy routing: rule priorities must be distinct, got %+v", o)
+	}
+	return nil
+}
+
+// These CLI flags cover every PolicyRoutingOptions field, defaulted from
+// DefaultPolicyRoutingOptions; optionsFromFlags reads them.
+var (
+	flagTable                    = flag.Int("policy-routing-table", DefaultPolicyRoutingOptions.Table, "route table used for the default-NIC policy route")
+	flagHairpinRulePrio          = flag.Int("policy-routing-hairpin-priority", DefaultPolicyRoutingOptions.HairpinRulePriority, "ip rule priority for the hairpin-mark rule")
+	flagLocalRulePrio            = flag.Int("policy-routing-local-priority", DefaultPolicyRoutingOptions.LocalRulePriority, "ip rule priority for the loopback rule")
+	flagPolicyRoutingRulePrio    = flag.Int("policy-routing-rule-priority", DefaultPolicyRoutingOptions.PolicyRoutingRulePriority, "ip rule priority for the default-NIC-invert rule")
+	flagHairpinMark              = flag.String("policy-routing-hairpin-mark", fmt.Sprintf("0x%x", DefaultPolicyRoutingOptions.HairpinMark), "fwmark (hex) used to recognize hairpinned traffic")
+	flagHairpinMask              = flag.String("policy-routing-hairpin-mask", fmt.Sprintf("0x%x", DefaultPolicyRoutingOptions.HairpinMask), "fwmask (hex) applied alongside -policy-routing-hairpin-mark")
+	flagChainPrefix              = flag.String("policy-routing-chain-prefix", DefaultPolicyRoutingOptions.ChainPrefix, "prefix for the PREROUTING/POSTROUTING chains netd installs")
+	flagReversePathFilter        = flag.String("policy-routing-rp-filter", DefaultPolicyRoutingOptions.ReversePathFilterValue, "value written to the default NIC's rp_filter sysctl")
 )
 
+// optionsFromFlags builds a PolicyRoutingOptions from the flags above.
+func optionsFromFlags() (PolicyRoutingOptions, error) {
+	var mark, mask uint64
+	if _, err := fmt.Sscanf(*flagHairpinMark, "0x%x", &mark); err != nil {
+		return PolicyRoutingOptions{}, fmt.Errorf("parsing -policy-routing-hairpin-mark %q: %w", *flagHairpinMark, err)
+	}
+	if _, err := fmt.Sscanf(*flagHairpinMask, "0x%x", &mask); err != nil {
+		return PolicyRoutingOptions{}, fmt.Errorf("parsing -policy-routing-hairpin-mask %q: %w", *flagHairpinMask, err)
+	}
+
+	opts := PolicyRoutingOptions{
+		Table:                     *flagTable,
+		HairpinRulePriority:       *flagHairpinRulePrio,
+		LocalRulePriority:         *flagLocalRulePrio,
+		PolicyRoutingRulePriority: *flagPolicyRoutingRulePrio,
+		HairpinMark:               uint32(mark),
+		HairpinMask:               uint32(mask),
+		ChainPrefix:               *flagChainPrefix,
+		ReversePathFilterValue:    *flagReversePathFilter,
+	}
+	if err := opts.Validate(); err != nil {
+		return PolicyRoutingOptions{}, err
+	}
+	return opts, nil
+}
+
+// currentOptions is the PolicyRoutingOptions that produced
+// PolicyRoutingConfigSet; the route monitor in
+// config_policy_routing_monitor.go reads it back to know which table/
+// priority identify the entries it's allowed to reconcile.
+var currentOptions = DefaultPolicyRoutingOptions
+
+// defaultProbeV6 is the well-known address used to resolve the default IPv6
+// route/NIC, mirroring the 8.8.8.8 probe used for IPv4.
+var defaultProbeV6 = net.ParseIP("2001:4860:4860::8888")
+
 var (
 	defaultGateway   net.IP
 	defaultLinkIndex int
 	defaultNetdev    string
 	localLinkIndex   int
 	localNetdev      string
+
+	// v6 mirrors the v4 fields above but for the default IPv6 route.
+	// ipv6Available is false on hosts without a usable default IPv6 route
+	// (one with both a NIC and a gateway), in which case no IPv6 rules are
+	// installed at all.
+	defaultGateway6   net.IP
+	defaultLinkIndex6 int
+	defaultNetdev6    string
+	ipv6Available     bool
 )
 
 // PolicyRoutingConfigSet defines the Policy Routing rules
-var PolicyRoutingConfigSet = Set{
-	false,
-	"PolicyRouting",
-	nil,
-}
+var PolicyRoutingConfigSet = Set{}
 
-func init() {
-	f := func(ip net.IP) (linkIndex int, netdev string, gw net.IP) {
-		nic, err := systemutil.GetNIC(ip)
-		if err != nil {
-			glog.Error(err)
-			if errors.Is(err, systemutil.ErrFailedRoute) {
-				return
-			}
+// probeDefaultNIC resolves the link/gateway a packet to ip would currently
+// take, by asking the kernel for the route to it. It's used both for the
+// one-time setup in init() and by the route monitor in
+// config_policy_routing_monitor.go to re-probe after the default route
+// changes.
+func probeDefaultNIC(ip net.IP) (linkIndex int, netdev string, gw net.IP) {
+	nic, err := systemutil.GetNIC(ip)
+	if err != nil {
+		glog.Error(err)
+		if errors.Is(err, systemutil.ErrFailedRoute) {
+			return
 		}
+	}
 
-		gw = nic.Route.Gw
-		linkIndex = nic.Route.LinkIndex
-		netdev = nic.Link.Name
+	gw = nic.Route.Gw
+	linkIndex = nic.Route.LinkIndex
+	netdev = nic.Link.Name
 
-		return
+	return
+}
+
+func init() {
+	opts, err := optionsFromFlags()
+	if err != nil {
+		glog.Error(err)
+		opts = DefaultPolicyRoutingOptions
+	}
+	PolicyRoutingConfigSet = NewPolicyRoutingConfigSet(opts)
+}
+
+// reversePathFilterValueV6 adapts a configured rp_filter value for IPv6 use.
+// rp_filter=2 ("loose" mode) was only ever an IPv4 concept; the IPv6 stack
+// only recognizes 0 (off) and 1 (strict), and silently treats anything else
+// as 1. Rather than rely on that kernel fallback, clamp 2 to 1 ourselves so
+// the value netd reports matches what's actually enforced.
+func reversePathFilterValueV6(v string) string {
+	if v == "2" {
+		return "1"
 	}
-	defaultLinkIndex, defaultNetdev, defaultGateway = f(net.IPv4(8, 8, 8, 8))
-	localLinkIndex, localNetdev, _ = f(net.IPv4(127, 0, 0, 1))
+	return v
+}
 
-	sysctlReversePathFilter := fmt.Sprintf("net.ipv4.conf.%s.rp_filter", defaultNetdev)
-	PolicyRoutingConfigSet.Configs = []Config{
+// NewPolicyRoutingConfigSet probes the host's default NICs and builds a
+// Set of policy routing Configs from opts. Unlike the old fixed init()
+// body this can be called more than once per process (tests exercise it
+// with several PolicyRoutingOptions), though the package-level NIC/state
+// vars it populates are still shared with the route monitor.
+func NewPolicyRoutingConfigSet(opts PolicyRoutingOptions) Set {
+	currentOptions = opts
+
+	defaultLinkIndex, defaultNetdev, defaultGateway = probeDefaultNIC(net.IPv4(8, 8, 8, 8))
+	localLinkIndex, localNetdev, _ = probeDefaultNIC(net.IPv4(127, 0, 0, 1))
+
+	defaultLinkIndex6, defaultNetdev6, defaultGateway6 = probeDefaultNIC(defaultProbeV6)
+	ipv6Available = defaultNetdev6 != "" && defaultGateway6 != nil
+
+	backend := resolvePolicyRoutingBackend()
+
+	configs := []Config{
 		SysctlConfig{
-			Key:          sysctlReversePathFilter,
-			Value:        "2",
+			Key:          fmt.Sprintf("net.ipv4.conf.%s.rp_filter", defaultNetdev),
+			Value:        opts.ReversePathFilterValue,
 			DefaultValue: "1",
 			SysctlFunc:   sysctl.Sysctl,
 		},
@@ -106,55 +316,28 @@ func init() {
 			DefaultValue: "0",
 			SysctlFunc:   sysctl.Sysctl,
 		},
-		IPTablesRulesConfig{
-			Spec: ipt.IPTablesSpec{
-				TableName: tableMangle,
-				ChainName: gcpPreRoutingChain,
-				Rules: []ipt.IPTablesRule{
-					[]string{"-j", "CONNMARK", "--restore-mark", "-m", "comment", "--comment", policyRoutingGcpPreRoutingComment},
-				},
-				IPT: ipt.IPv4Tables,
-			},
-			IsDefaultChain: false,
-		},
-		IPTablesRulesConfig{
-			Spec: ipt.IPTablesSpec{
-				TableName: tableMangle,
-				ChainName: preRoutingChain,
-				Rules: []ipt.IPTablesRule{
-					[]string{"-j", gcpPreRoutingChain, "-m", "comment", "--comment", policyRoutingPreRoutingComment},
-				},
-				IPT: ipt.IPv4Tables,
-			},
-			IsDefaultChain: true,
-		},
-		IPTablesRulesConfig{
-			Spec: ipt.IPTablesSpec{
-				TableName: tableMangle,
-				ChainName: gcpPostRoutingChain,
-				Rules: []ipt.IPTablesRule{
-					[]string{"-m", "mark", "--mark",
-						fmt.Sprintf("0x%x/0x%x", hairpinMark, hairpinMask),
-						"-j", "CONNMARK", "--save-mark", "-m", "comment", "--comment", policyRoutingGcpPostRoutingComment},
-				},
-				IPT: ipt.IPv4Tables,
-			},
-			IsDefaultChain: false,
-		},
-		IPTablesRulesConfig{
-			Spec: ipt.IPTablesSpec{
-				TableName: tableMangle,
-				ChainName: postRoutingChain,
-				Rules: []ipt.IPTablesRule{
-					[]string{"-j", gcpPostRoutingChain, "-m", "comment", "--comment", policyRoutingPostRoutingComment},
-				},
-				IPT: ipt.IPv4Tables,
-			},
-			IsDefaultChain: true,
-		},
+	}
+	if ipv6Available {
+		configs = append(configs, SysctlConfig{
+			Key:          fmt.Sprintf("net.ipv6.conf.%s.rp_filter", defaultNetdev6),
+			Value:        reversePathFilterValueV6(opts.ReversePathFilterValue),
+			DefaultValue: "1",
+			SysctlFunc:   sysctl.Sysctl,
+		})
+	}
+
+	configs = append(configs, markChainConfigs(backend, unix.AF_INET, opts)...)
+	if ipv6Available {
+		configs = append(configs, markChainConfigs(backend, unix.AF_INET6, opts)...)
+	} else {
+		glog.Warning("no default IPv6 route found, skipping IPv6 policy routing rules")
+	}
+
+	configs = append(configs, []Config{
 		IPRouteConfig{
 			Route: netlink.Route{
-				Table:     customRouteTable,
+				Family:    unix.AF_INET,
+				Table:     opts.Table,
 				LinkIndex: defaultLinkIndex,
 				Gw:        defaultGateway,
 				Dst:       nil,
@@ -164,10 +347,11 @@ func init() {
 		},
 		IPRuleConfig{
 			Rule: netlink.Rule{
-				Mark:              hairpinMark,
-				Mask:              hairpinMask,
+				Family:            unix.AF_INET,
+				Mark:              int(opts.HairpinMark),
+				Mask:              int(opts.HairpinMask),
 				Table:             unix.RT_TABLE_MAIN,
-				Priority:          hairpinRulePriority,
+				Priority:          opts.HairpinRulePriority,
 				SuppressIfgroup:   -1,
 				SuppressPrefixlen: -1,
 				Goto:              -1,
@@ -179,9 +363,10 @@ func init() {
 		},
 		IPRuleConfig{
 			Rule: netlink.Rule{
+				Family:            unix.AF_INET,
 				IifName:           localNetdev,
 				Table:             unix.RT_TABLE_MAIN,
-				Priority:          localRulePriority,
+				Priority:          opts.LocalRulePriority,
 				SuppressIfgroup:   -1,
 				SuppressPrefixlen: -1,
 				Mark:              -1,
@@ -195,10 +380,11 @@ func init() {
 		},
 		IPRuleConfig{
 			Rule: netlink.Rule{
+				Family:            unix.AF_INET,
 				IifName:           defaultNetdev,
 				Invert:            true,
-				Table:             customRouteTable,
-				Priority:          policyRoutingRulePriority,
+				Table:             opts.Table,
+				Priority:          opts.PolicyRoutingRulePriority,
 				SuppressIfgroup:   -1,
 				SuppressPrefixlen: -1,
 				Mark:              -1,
@@ -210,5 +396,180 @@ func init() {
 			RuleDel:  netlink.RuleDel,
 			RuleList: netlink.RuleList,
 		},
+	}...)
+
+	if ipv6Available {
+		configs = append(configs, []Config{
+			IPRouteConfig{
+				Route: netlink.Route{
+					Family:    unix.AF_INET6,
+					Table:     opts.Table,
+					LinkIndex: defaultLinkIndex6,
+					Gw:        defaultGateway6,
+					Dst:       nil,
+				},
+				RouteAdd: netlink.RouteAdd,
+				RouteDel: netlink.RouteDel,
+			},
+			IPRuleConfig{
+				Rule: netlink.Rule{
+					Family:            unix.AF_INET6,
+					Mark:              int(opts.HairpinMark),
+					Mask:              int(opts.HairpinMask),
+					Table:             unix.RT_TABLE_MAIN,
+					Priority:          opts.HairpinRulePriority,
+					SuppressIfgroup:   -1,
+					SuppressPrefixlen: -1,
+					Goto:              -1,
+					Flow:              -1,
+				},
+				RuleAdd:  netlink.RuleAdd,
+				RuleDel:  netlink.RuleDel,
+				RuleList: netlink.RuleList,
+			},
+			IPRuleConfig{
+				Rule: netlink.Rule{
+					Family:            unix.AF_INET6,
+					IifName:           localNetdev,
+					Table:             unix.RT_TABLE_MAIN,
+					Priority:          opts.LocalRulePriority,
+					SuppressIfgroup:   -1,
+					SuppressPrefixlen: -1,
+					Mark:              -1,
+					Mask:              -1,
+					Goto:              -1,
+					Flow:              -1,
+				},
+				RuleAdd:  netlink.RuleAdd,
+				RuleDel:  netlink.RuleDel,
+				RuleList: netlink.RuleList,
+			},
+			IPRuleConfig{
+				Rule: netlink.Rule{
+					Family:            unix.AF_INET6,
+					IifName:           defaultNetdev6,
+					Invert:            true,
+					Table:             opts.Table,
+					Priority:          opts.PolicyRoutingRulePriority,
+					SuppressIfgroup:   -1,
+					SuppressPrefixlen: -1,
+					Mark:              -1,
+					Mask:              -1,
+					Goto:              -1,
+					Flow:              -1,
+				},
+				RuleAdd:  netlink.RuleAdd,
+				RuleDel:  netlink.RuleDel,
+				RuleList: netlink.RuleList,
+			},
+		}...)
 	}
-}
\ No newline at end of file
+
+	return Set{
+		Name:    "PolicyRouting",
+		Configs: configs,
+	}
+}
+
+// markChainConfigs builds the <prefix>PREROUTING/<prefix>POSTROUTING mark
+// restore/save chains (and the jumps into them from the mangle
+// PREROUTING/POSTROUTING base chains) for the given backend ("iptables" or
+// "nftables") and address family (unix.AF_INET or unix.AF_INET6).
+func markChainConfigs(backend string, family int, opts PolicyRoutingOptions) []Config {
+	gcpPreRoutingChain := opts.ChainPrefix + preRoutingChain
+	gcpPostRoutingChain := opts.ChainPrefix + postRoutingChain
+	policyRoutingGcpPreRoutingComment := "restore the conn mark if applicable"
+	policyRoutingPreRoutingComment := fmt.Sprintf("redirect all traffic to %s chain", gcpPreRoutingChain)
+	policyRoutingGcpPostRoutingComment := fmt.Sprintf("save the conn mark only if hairpin bit (0x%x/0x%x) is set", opts.HairpinMark, opts.HairpinMask)
+	policyRoutingPostRoutingComment := fmt.Sprintf("redirect all traffic to %s chain", gcpPostRoutingChain)
+
+	if backend == "nftables" {
+		nftFamily := nftables.TableFamilyIPv4
+		if family == unix.AF_INET6 {
+			nftFamily = nftables.TableFamilyIPv6
+		}
+		return []Config{
+			NFTablesRulesConfig{
+				Family:      nftFamily,
+				ChainName:   gcpPreRoutingChain,
+				IsBaseChain: false,
+				Rules:       [][]expr.Any{restoreMarkExprs()},
+			},
+			NFTablesRulesConfig{
+				Family:      nftFamily,
+				ChainName:   preRoutingChain,
+				IsBaseChain: true,
+				Hook:        nftables.ChainHookPrerouting,
+				Priority:    nftables.ChainPriorityMangle,
+				Rules:       [][]expr.Any{jumpExprs(gcpPreRoutingChain)},
+			},
+			NFTablesRulesConfig{
+				Family:      nftFamily,
+				ChainName:   gcpPostRoutingChain,
+				IsBaseChain: false,
+				Rules:       [][]expr.Any{saveMarkExprs(opts.HairpinMark, opts.HairpinMask)},
+			},
+			NFTablesRulesConfig{
+				Family:      nftFamily,
+				ChainName:   postRoutingChain,
+				IsBaseChain: true,
+				Hook:        nftables.ChainHookPostrouting,
+				Priority:    nftables.ChainPriorityMangle,
+				Rules:       [][]expr.Any{jumpExprs(gcpPostRoutingChain)},
+			},
+		}
+	}
+
+	iptHandle := ipt.IPv4Tables
+	if family == unix.AF_INET6 {
+		iptHandle = ipt.IPv6Tables
+	}
+	return []Config{
+		IPTablesRulesConfig{
+			Spec: ipt.IPTablesSpec{
+				TableName: tableMangle,
+				ChainName: gcpPreRoutingChain,
+				Rules: []ipt.IPTablesRule{
+					[]string{"-j", "CONNMARK", "--restore-mark", "-m", "comment", "--comment", policyRoutingGcpPreRoutingComment},
+				},
+				IPT: iptHandle,
+			},
+			IsDefaultChain: false,
+		},
+		IPTablesRulesConfig{
+			Spec: ipt.IPTablesSpec{
+				TableName: tableMangle,
+				ChainName: preRoutingChain,
+				Rules: []ipt.IPTablesRule{
+					[]string{"-j", gcpPreRoutingChain, "-m", "comment", "--comment", policyRoutingPreRoutingComment},
+				},
+				IPT: iptHandle,
+			},
+			IsDefaultChain: true,
+		},
+		IPTablesRulesConfig{
+			Spec: ipt.IPTablesSpec{
+				TableName: tableMangle,
+				ChainName: gcpPostRoutingChain,
+				Rules: []ipt.IPTablesRule{
+					[]string{"-m", "mark", "--mark",
+						fmt.Sprintf("0x%x/0x%x", opts.HairpinMark, opts.HairpinMask),
+						"-j", "CONNMARK", "--save-mark", "-m", "comment", "--comment", policyRoutingGcpPostRoutingComment},
+				},
+				IPT: iptHandle,
+			},
+			IsDefaultChain: false,
+		},
+		IPTablesRulesConfig{
+			Spec: ipt.IPTablesSpec{
+				TableName: tableMangle,
+				ChainName: postRoutingChain,
+				Rules: []ipt.IPTablesRule{
+					[]string{"-j", gcpPostRoutingChain, "-m", "comment", "--comment", policyRoutingPostRoutingComment},
+				},
+				IPT: iptHandle,
+			},
+			IsDefaultChain: true,
+		},
+	}
+}
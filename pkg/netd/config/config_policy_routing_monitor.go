@@ -0,0 +1,148 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// policyRoutingMu guards the defaultNetdev/defaultLinkIndex/defaultGateway
+// (and their v6 counterparts) package vars, plus PolicyRoutingConfigSet.Configs,
+// against concurrent reads from the monitor goroutine below and writes
+// triggered by reconcileDefaultLink.
+var policyRoutingMu sync.Mutex
+
+// defaultLinkMonitor watches RTNETLINK for link and default-route changes
+// and keeps PolicyRoutingConfigSet's IPRouteConfig/IPRuleConfig entries
+// pointed at whatever NIC currently owns the default route. Without this,
+// a route flap on a multi-NIC node (secondary NIC promotion, bond
+// failover) leaves the hairpin/policy-routing rules bound to an interface
+// that's no longer the default, and egress marking silently stops working.
+type defaultLinkMonitor struct {
+	done chan struct{}
+}
+
+// StartDefaultLinkMonitor starts a background goroutine that reconciles
+// PolicyRoutingConfigSet whenever the default route changes, and returns a
+// Closer that stops it. It is safe to call at most once per process.
+func StartDefaultLinkMonitor() (io.Closer, error) {
+	linkUpdates := make(chan netlink.LinkUpdate)
+	routeUpdates := make(chan netlink.RouteUpdate)
+	done := make(chan struct{})
+
+	if err := netlink.LinkSubscribe(linkUpdates, done); err != nil {
+		close(done)
+		return nil, err
+	}
+	if err := netlink.RouteSubscribe(routeUpdates, done); err != nil {
+		close(done)
+		return nil, err
+	}
+
+	m := &defaultLinkMonitor{done: done}
+	go m.run(linkUpdates, routeUpdates)
+
+	return m, nil
+}
+
+// Close stops the monitor goroutine.
+func (m *defaultLinkMonitor) Close() error {
+	close(m.done)
+	return nil
+}
+
+func (m *defaultLinkMonitor) run(linkUpdates <-chan netlink.LinkUpdate, routeUpdates <-chan netlink.RouteUpdate) {
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-linkUpdates:
+			m.reconcile()
+		case ru := <-routeUpdates:
+			// Only default-route (Dst == nil) changes can move the
+			// NIC our rules are bound to; ignore everything else to
+			// avoid reconciling on every route churn.
+			if ru.Route.Dst == nil {
+				m.reconcile()
+			}
+		}
+	}
+}
+
+func (m *defaultLinkMonitor) reconcile() {
+	reconcileDefaultLink(net.IPv4(8, 8, 8, 8), unix.AF_INET)
+	if ipv6Available {
+		reconcileDefaultLink(defaultProbeV6, unix.AF_INET6)
+	}
+	if err := ReconcileSecondaryNICs(); err != nil {
+		glog.Errorf("reconciling secondary NIC policy routing: %v", err)
+	}
+}
+
+// reconcileDefaultLink re-probes the default NIC for family and, if it has
+// changed, removes the stale IPRouteConfig/IPRuleConfig entries from
+// PolicyRoutingConfigSet and installs fresh ones in their place.
+func reconcileDefaultLink(probe net.IP, family int) {
+	linkIndex, netdev, gw := probeDefaultNIC(probe)
+
+	policyRoutingMu.Lock()
+	defer policyRoutingMu.Unlock()
+
+	oldNetdev := defaultNetdev
+	if family == unix.AF_INET6 {
+		oldNetdev = defaultNetdev6
+	}
+	if netdev == "" || netdev == oldNetdev {
+		return
+	}
+
+	glog.Infof("default NIC for family %d changed from %q to %q, reconciling policy routing rules", family, oldNetdev, netdev)
+
+	for i, c := range PolicyRoutingConfigSet.Configs {
+		switch cfg := c.(type) {
+		case IPRouteConfig:
+			if cfg.Route.Table != currentOptions.Table || cfg.Route.Family != family {
+				continue
+			}
+			emitConfigRemove(cfg)
+			cfg.Route.LinkIndex = linkIndex
+			cfg.Route.Gw = gw
+			emitConfigAdd(cfg)
+			PolicyRoutingConfigSet.Configs[i] = cfg
+		case IPRuleConfig:
+			if cfg.Rule.Family != family || cfg.Rule.Table != currentOptions.Table || !cfg.Rule.Invert {
+				continue
+			}
+			emitConfigRemove(cfg)
+			cfg.Rule.IifName = netdev
+			emitConfigAdd(cfg)
+			PolicyRoutingConfigSet.Configs[i] = cfg
+		}
+	}
+
+	if family == unix.AF_INET6 {
+		defaultLinkIndex6, defaultNetdev6, defaultGateway6 = linkIndex, netdev, gw
+	} else {
+		defaultLinkIndex, defaultNetdev, defaultGateway = linkIndex, netdev, gw
+	}
+}
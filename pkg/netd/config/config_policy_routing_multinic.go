@@ -0,0 +1,287 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// secondaryNICTableBase is added to opts.Table to start allocating route
+// tables for secondary NICs, so they never collide with the primary
+// default-NIC table.
+const secondaryNICTableBase = 1
+
+// secondaryNICPriorityStride spaces each secondary NIC's pair of ip rules
+// (src-based and iif-invert) out from opts.PolicyRoutingRulePriority and
+// from each other.
+const secondaryNICPriorityStride = 2
+
+// secondaryNICKey identifies one (netdev, address family) pair. A
+// dual-stack secondary NIC shows up in listSecondaryNICs as two distinct
+// secondaryNIC entries with the same Name but different Family, each
+// needing its own route table, so Name alone isn't a unique key.
+type secondaryNICKey struct {
+	Name   string
+	Family int
+}
+
+// secondaryNICTables maps (netdev name, family) -> the route table id
+// allocated to it, for every secondary NIC currently represented in
+// PolicyRoutingConfigSet.Configs. Guarded by policyRoutingMu.
+var secondaryNICTables = map[secondaryNICKey]int{}
+
+// secondaryNIC describes one non-default NIC eligible for its own
+// per-source policy routing table.
+type secondaryNIC struct {
+	LinkIndex int
+	Name      string
+	Family    int
+	PrimaryIP net.IP
+	Gateway   net.IP
+}
+
+// listSecondaryNICs enumerates every NIC other than the default and
+// loopback ones that has both a default route and an address, i.e. every
+// NIC that could plausibly carry its own egress traffic (additional VPC
+// NICs on a multi-NIC GCE instance).
+func listSecondaryNICs() ([]secondaryNIC, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("listing links: %w", err)
+	}
+
+	var nics []secondaryNIC
+	for _, link := range links {
+		attrs := link.Attrs()
+		if attrs.Name == defaultNetdev || attrs.Name == localNetdev || attrs.Name == "lo" {
+			continue
+		}
+
+		families := []int{unix.AF_INET}
+		if ipv6Available {
+			families = append(families, unix.AF_INET6)
+		}
+
+		for _, family := range families {
+			routes, err := netlink.RouteList(link, family)
+			if err != nil {
+				glog.Errorf("listing routes on %s: %v", attrs.Name, err)
+				continue
+			}
+			var gw net.IP
+			for _, r := range routes {
+				if r.Dst == nil && r.Gw != nil {
+					gw = r.Gw
+					break
+				}
+			}
+			if gw == nil {
+				continue
+			}
+
+			addrs, err := netlink.AddrList(link, family)
+			if err != nil || len(addrs) == 0 {
+				continue
+			}
+
+			nics = append(nics, secondaryNIC{
+				LinkIndex: attrs.Index,
+				Name:      attrs.Name,
+				Family:    family,
+				PrimaryIP: addrs[0].IP,
+				Gateway:   gw,
+			})
+		}
+	}
+	return nics, nil
+}
+
+// allocateSecondaryTable picks the lowest route table at or above
+// opts.Table+secondaryNICTableBase that isn't already claimed by another
+// tracked secondary NIC.
+func allocateSecondaryTable(opts PolicyRoutingOptions) int {
+	used := map[int]bool{}
+	for _, t := range secondaryNICTables {
+		used[t] = true
+	}
+	for t := opts.Table + secondaryNICTableBase; ; t++ {
+		if !used[t] {
+			return t
+		}
+	}
+}
+
+// secondaryNICConfigs builds the default route plus the symmetric
+// src-based/iif-invert ip rule pair that route nic's traffic through
+// table.
+func secondaryNICConfigs(nic secondaryNIC, table, priority int) []Config {
+	mask := net.CIDRMask(32, 32)
+	if nic.Family == unix.AF_INET6 {
+		mask = net.CIDRMask(128, 128)
+	}
+
+	return []Config{
+		IPRouteConfig{
+			Route: netlink.Route{
+				Family:    nic.Family,
+				Table:     table,
+				LinkIndex: nic.LinkIndex,
+				Gw:        nic.Gateway,
+				Dst:       nil,
+			},
+			RouteAdd: netlink.RouteAdd,
+			RouteDel: netlink.RouteDel,
+		},
+		IPRuleConfig{
+			Rule: netlink.Rule{
+				Family:            nic.Family,
+				Src:               &net.IPNet{IP: nic.PrimaryIP, Mask: mask},
+				Table:             table,
+				Priority:          priority,
+				SuppressIfgroup:   -1,
+				SuppressPrefixlen: -1,
+				Mark:              -1,
+				Mask:              -1,
+				Goto:              -1,
+				Flow:              -1,
+			},
+			RuleAdd:  netlink.RuleAdd,
+			RuleDel:  netlink.RuleDel,
+			RuleList: netlink.RuleList,
+		},
+		IPRuleConfig{
+			Rule: netlink.Rule{
+				Family:            nic.Family,
+				IifName:           nic.Name,
+				Invert:            true,
+				Table:             table,
+				Priority:          priority + 1,
+				SuppressIfgroup:   -1,
+				SuppressPrefixlen: -1,
+				Mark:              -1,
+				Mask:              -1,
+				Goto:              -1,
+				Flow:              -1,
+			},
+			RuleAdd:  netlink.RuleAdd,
+			RuleDel:  netlink.RuleDel,
+			RuleList: netlink.RuleList,
+		},
+	}
+}
+
+// planSecondaryNICs diffs nics against tracked (secondaryNICTables' current
+// contents) and reports which nics need a table installed and which
+// tracked keys have disappeared and need tearing down. It's pure so the
+// dual-stack bookkeeping (same Name, different Family entries must be
+// tracked independently) can be tested without touching netlink.
+func planSecondaryNICs(nics []secondaryNIC, tracked map[secondaryNICKey]int) (toInstall []secondaryNIC, toRemove []secondaryNICKey) {
+	seen := map[secondaryNICKey]bool{}
+	for _, nic := range nics {
+		key := secondaryNICKey{Name: nic.Name, Family: nic.Family}
+		seen[key] = true
+		if _, ok := tracked[key]; ok {
+			continue
+		}
+		toInstall = append(toInstall, nic)
+	}
+	for key := range tracked {
+		if !seen[key] {
+			toRemove = append(toRemove, key)
+		}
+	}
+	return toInstall, toRemove
+}
+
+// ReconcileSecondaryNICs enumerates secondary NICs and diffs them against
+// secondaryNICTables: it installs a fresh per-NIC route table for any NIC
+// not already tracked, and tears down the table for any tracked NIC that
+// disappeared (e.g. detached from a multi-VPC GCE instance). It's meant to
+// be called from the same link monitor that drives reconcileDefaultLink.
+func ReconcileSecondaryNICs() error {
+	// listSecondaryNICs reads defaultNetdev, which reconcileDefaultLink
+	// mutates under policyRoutingMu from the monitor goroutine, so it needs
+	// to run under the same lock rather than before it.
+	policyRoutingMu.Lock()
+	defer policyRoutingMu.Unlock()
+
+	nics, err := listSecondaryNICs()
+	if err != nil {
+		return err
+	}
+
+	toInstall, toRemove := planSecondaryNICs(nics, secondaryNICTables)
+
+	for _, nic := range toInstall {
+		key := secondaryNICKey{Name: nic.Name, Family: nic.Family}
+		table := allocateSecondaryTable(currentOptions)
+		priority := currentOptions.PolicyRoutingRulePriority + secondaryNICPriorityStride*(table-currentOptions.Table)
+		configs := secondaryNICConfigs(nic, table, priority)
+
+		failed := false
+		for _, c := range configs {
+			if err := emitConfigAdd(c); err != nil {
+				failed = true
+				break
+			}
+		}
+		if failed {
+			glog.Errorf("not tracking table %d for secondary NIC %s family %d: failed to install", table, nic.Name, nic.Family)
+			continue
+		}
+
+		secondaryNICTables[key] = table
+		PolicyRoutingConfigSet.Configs = append(PolicyRoutingConfigSet.Configs, configs...)
+		glog.Infof("installed policy routing table %d for secondary NIC %s family %d", table, nic.Name, nic.Family)
+	}
+
+	for _, key := range toRemove {
+		table := secondaryNICTables[key]
+
+		var kept []Config
+		for _, c := range PolicyRoutingConfigSet.Configs {
+			if configTable(c) == table {
+				emitConfigRemove(c)
+				continue
+			}
+			kept = append(kept, c)
+		}
+		PolicyRoutingConfigSet.Configs = kept
+		delete(secondaryNICTables, key)
+		glog.Infof("removed policy routing table %d for departed secondary NIC %s family %d", table, key.Name, key.Family)
+	}
+
+	return nil
+}
+
+// configTable returns the route table an IPRouteConfig/IPRuleConfig
+// targets, or -1 for any other Config kind.
+func configTable(c Config) int {
+	switch cfg := c.(type) {
+	case IPRouteConfig:
+		return cfg.Route.Table
+	case IPRuleConfig:
+		return cfg.Rule.Table
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestAllocateSecondaryTable(t *testing.T) {
+	orig := secondaryNICTables
+	defer func() { secondaryNICTables = orig }()
+
+	opts := DefaultPolicyRoutingOptions
+	want := opts.Table + secondaryNICTableBase
+
+	secondaryNICTables = map[secondaryNICKey]int{}
+	if got := allocateSecondaryTable(opts); got != want {
+		t.Fatalf("allocateSecondaryTable() = %d, want %d", got, want)
+	}
+
+	secondaryNICTables = map[secondaryNICKey]int{{Name: "eth1", Family: unix.AF_INET}: want}
+	if got := allocateSecondaryTable(opts); got != want+1 {
+		t.Fatalf("allocateSecondaryTable() with %d taken = %d, want %d", want, got, want+1)
+	}
+
+	secondaryNICTables = map[secondaryNICKey]int{
+		{Name: "eth1", Family: unix.AF_INET}: want,
+		{Name: "eth2", Family: unix.AF_INET}: want + 1,
+	}
+	if got := allocateSecondaryTable(opts); got != want+2 {
+		t.Fatalf("allocateSecondaryTable() with %d,%d taken = %d, want %d", want, want+1, got, want+2)
+	}
+}
+
+// TestPlanSecondaryNICsDualStack covers the bug where a dual-stack
+// secondary NIC (same Name, one secondaryNIC entry per Family) only had its
+// first family's table installed: planSecondaryNICs must treat
+// (eth1, AF_INET) and (eth1, AF_INET6) as independent keys.
+func TestPlanSecondaryNICsDualStack(t *testing.T) {
+	nics := []secondaryNIC{
+		{Name: "eth1", Family: unix.AF_INET},
+		{Name: "eth1", Family: unix.AF_INET6},
+	}
+
+	toInstall, toRemove := planSecondaryNICs(nics, map[secondaryNICKey]int{})
+	if len(toRemove) != 0 {
+		t.Fatalf("toRemove = %v, want none", toRemove)
+	}
+	if len(toInstall) != 2 {
+		t.Fatalf("toInstall = %v, want both families of eth1 installed", toInstall)
+	}
+
+	// Once the v4 table is tracked, only the v6 entry should remain to
+	// install; the v6 entry must not be skipped because of the v4 entry
+	// already being tracked under the same Name.
+	tracked := map[secondaryNICKey]int{{Name: "eth1", Family: unix.AF_INET}: 2}
+	toInstall, toRemove = planSecondaryNICs(nics, tracked)
+	if len(toRemove) != 0 {
+		t.Fatalf("toRemove = %v, want none", toRemove)
+	}
+	if len(toInstall) != 1 || toInstall[0].Family != unix.AF_INET6 {
+		t.Fatalf("toInstall = %v, want only the AF_INET6 entry", toInstall)
+	}
+}
+
+// TestPlanSecondaryNICsRemoval covers a tracked NIC disappearing from the
+// nics list (e.g. detached from the instance).
+func TestPlanSecondaryNICsRemoval(t *testing.T) {
+	tracked := map[secondaryNICKey]int{
+		{Name: "eth1", Family: unix.AF_INET}: 2,
+		{Name: "eth2", Family: unix.AF_INET}: 3,
+	}
+	nics := []secondaryNIC{{Name: "eth1", Family: unix.AF_INET}}
+
+	toInstall, toRemove := planSecondaryNICs(nics, tracked)
+	if len(toInstall) != 0 {
+		t.Fatalf("toInstall = %v, want none", toInstall)
+	}
+	if len(toRemove) != 1 || toRemove[0] != (secondaryNICKey{Name: "eth2", Family: unix.AF_INET}) {
+		t.Fatalf("toRemove = %v, want only eth2/AF_INET", toRemove)
+	}
+}
+
+func TestConfigTable(t *testing.T) {
+	route := IPRouteConfig{Route: netlink.Route{Table: 5}}
+	rule := IPRuleConfig{Rule: netlink.Rule{Table: 7}}
+
+	if got := configTable(route); got != 5 {
+		t.Errorf("configTable(IPRouteConfig) = %d, want 5", got)
+	}
+	if got := configTable(rule); got != 7 {
+		t.Errorf("configTable(IPRuleConfig) = %d, want 7", got)
+	}
+	if got := configTable(SysctlConfig{}); got != -1 {
+		t.Errorf("configTable(SysctlConfig) = %d, want -1", got)
+	}
+}
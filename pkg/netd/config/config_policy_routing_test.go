@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import "testing"
+
+func TestPolicyRoutingOptionsValidateDefault(t *testing.T) {
+	if err := DefaultPolicyRoutingOptions.Validate(); err != nil {
+		t.Fatalf("DefaultPolicyRoutingOptions.Validate() = %v, want nil", err)
+	}
+}
+
+func TestPolicyRoutingOptionsValidateHairpinMaskMismatch(t *testing.T) {
+	opts := DefaultPolicyRoutingOptions
+	opts.HairpinMark = 0x1
+	opts.HairpinMask = 0x4000
+	if err := opts.Validate(); err == nil {
+		t.Fatal("Validate() = nil, want error for mark not covered by mask")
+	}
+}
+
+func TestPolicyRoutingOptionsValidateReservedMark(t *testing.T) {
+	opts := DefaultPolicyRoutingOptions
+	opts.HairpinMark = 0x200
+	opts.HairpinMask = 0x200
+	if err := opts.Validate(); err == nil {
+		t.Fatal("Validate() = nil, want error for mark colliding with kube-proxy")
+	}
+}
+
+func TestPolicyRoutingOptionsValidateReservedTable(t *testing.T) {
+	opts := DefaultPolicyRoutingOptions
+	opts.Table = 1
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("Validate() = %v, want nil for the historical default table", err)
+	}
+
+	// A non-default table id that happens to collide with a reserved one
+	// must still be rejected.
+	opts.Table = 2
+	reservedTables[2] = "test reserved table"
+	defer delete(reservedTables, 2)
+	if err := opts.Validate(); err == nil {
+		t.Fatal("Validate() = nil, want error for table colliding with a reserved table")
+	}
+}
+
+func TestPolicyRoutingOptionsValidateReservedPriorityRange(t *testing.T) {
+	opts := DefaultPolicyRoutingOptions
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("Validate() = %v, want nil for the historical default priorities", err)
+	}
+
+	opts.PolicyRoutingRulePriority = 30500
+	if err := opts.Validate(); err == nil {
+		t.Fatal("Validate() = nil, want error for a priority in systemd-networkd's reserved range")
+	}
+}
+
+func TestPolicyRoutingOptionsValidateDuplicatePriorities(t *testing.T) {
+	opts := DefaultPolicyRoutingOptions
+	// Outside systemd-networkd's reserved range, so only the duplicate
+	// check can reject it.
+	opts.HairpinRulePriority = 20000
+	opts.LocalRulePriority = opts.HairpinRulePriority
+	if err := opts.Validate(); err == nil {
+		t.Fatal("Validate() = nil, want error for duplicate rule priorities")
+	}
+}
+
+func TestReversePathFilterValueV6(t *testing.T) {
+	cases := map[string]string{
+		"0": "0",
+		"1": "1",
+		"2": "1",
+	}
+	for in, want := range cases {
+		if got := reversePathFilterValueV6(in); got != want {
+			t.Errorf("reversePathFilterValueV6(%q) = %q, want %q", in, got, want)
+		}
+	}
+}